@@ -7,13 +7,16 @@ package client
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	// We use this ssh because it implements port redirection.
 	// It can not, however, unpack password-protected keys yet.
@@ -22,6 +25,7 @@ import (
 
 	// We use this ssh because it can unpack password-protected private keys.
 	ssh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 const (
@@ -32,12 +36,31 @@ const (
 var (
 	// DefaultKeyFile is the default key for cpu users.
 	DefaultKeyFile = filepath.Join(os.Getenv("HOME"), ".ssh/cpu_rsa")
+	// DefaultKeyFiles is the ordered list of private key files tried
+	// when ssh_config has no IdentityFile entry for the host.
+	DefaultKeyFiles = []string{
+		"~/.ssh/id_ed25519",
+		"~/.ssh/id_rsa",
+		"~/.ssh/cpu_rsa",
+	}
 	// Debug9p enables 9p debugging.
 	Debug9p bool
 	// Dump9p enables dumping 9p packets.
 	Dump9p bool
 	// DumpWriter is an io.Writer to which dump packets are written.
 	DumpWriter io.Writer = os.Stderr
+
+	// signerCache caches signers by the absolute path of the private
+	// key file they were decoded from, so a multi-host run only ever
+	// prompts for a given passphrase once.
+	signerCacheMu sync.Mutex
+	signerCache   = map[string]ssh.Signer{}
+
+	// agentMu guards cachedAgentClient, the single ssh-agent connection
+	// shared by every agentSigners/agentSignerForPublicKey call, so a
+	// multi-identity, multi-host run dials SSH_AUTH_SOCK at most once.
+	agentMu           sync.Mutex
+	cachedAgentClient agent.Agent
 )
 
 // a nonce is a [32]byte containing only printable characters, suitable for use as a string
@@ -63,35 +86,204 @@ func (n nonce) String() string {
 	return string(n[:])
 }
 
-// UserKeyConfig sets up authentication for a User Key.
+// UserKeyConfig sets up authentication for User Keys.
 // It is required in almost all cases.
+//
+// If c.PrivateKeyFile is set, it is the only key tried. Otherwise every
+// IdentityFile ssh_config returns for c.Host is tried, in order; if
+// ssh_config has nothing to say, DefaultKeyFiles is tried instead. Each
+// candidate that turns out to be passphrase-protected is resolved
+// against a running ssh-agent (via SSH_AUTH_SOCK) if it has a matching
+// key, and failing that via c.PassphrasePrompt. Decoded signers are
+// cached by absolute path, so re-running UserKeyConfig for other hosts
+// in the same process does not re-prompt.
+//
+// If c.AgentOnly is set, no key files are read at all: every signer the
+// agent offers is used as-is.
 func (c *Cmd) UserKeyConfig() error {
-	kf := c.PrivateKeyFile
-	if len(kf) == 0 {
-		kf = config.Get(c.Host, "IdentityFile")
-		V("key file from config is %q", kf)
-		if len(kf) == 0 {
-			kf = DefaultKeyFile
+	if c.AgentOnly {
+		signers, err := agentSigners()
+		if err != nil {
+			return fmt.Errorf("AgentOnly: %v", err)
+		}
+		if len(signers) == 0 {
+			return fmt.Errorf("AgentOnly: agent at %q offered no keys", os.Getenv("SSH_AUTH_SOCK"))
 		}
+		c.config.Auth = append(c.config.Auth, ssh.PublicKeys(signers...))
+		return nil
 	}
-	// The kf will always be non-zero at this point.
-	if strings.HasPrefix(kf, "~/") {
-		kf = filepath.Join(os.Getenv("HOME"), kf[1:])
+
+	paths := identityFiles(c.Host, c.PrivateKeyFile)
+	V("identity files for %q: %q", c.Host, paths)
+	var signers []ssh.Signer
+	var errs []error
+	for _, kf := range paths {
+		s, err := c.signerForFile(kf)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%q: %v", kf, err))
+			continue
+		}
+		signers = append(signers, s)
+	}
+	if len(signers) == 0 {
+		return fmt.Errorf("no usable private key among %q: %v", paths, errs)
+	}
+	c.config.Auth = append(c.config.Auth, ssh.PublicKeys(signers...))
+	return nil
+}
+
+// identityFiles returns the ordered list of candidate private key file
+// paths for host: kf alone if it is non-empty, else every IdentityFile
+// ssh_config knows about for host, else DefaultKeyFiles. Returned paths
+// have ~ expanded.
+func identityFiles(host, kf string) []string {
+	if len(kf) != 0 {
+		return []string{expandHome(kf)}
+	}
+	var paths []string
+	for _, f := range config.GetAll(host, "IdentityFile") {
+		paths = append(paths, expandHome(f))
+	}
+	if len(paths) == 0 {
+		for _, f := range DefaultKeyFiles {
+			paths = append(paths, expandHome(f))
+		}
+	}
+	return paths
+}
+
+// expandHome expands a leading ~/ in p to $HOME.
+func expandHome(p string) string {
+	if strings.HasPrefix(p, "~/") {
+		return filepath.Join(os.Getenv("HOME"), p[1:])
+	}
+	return p
+}
+
+// signerForFile returns a signer for the private key at path, decoding
+// it at most once per process: subsequent calls for the same absolute
+// path are served from signerCache. If the key is passphrase-protected,
+// a matching key offered by a running ssh-agent is preferred over
+// prompting.
+func (c *Cmd) signerForFile(path string) (ssh.Signer, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("abs path: %v", err)
+	}
+
+	signerCacheMu.Lock()
+	if s, ok := signerCache[abs]; ok {
+		signerCacheMu.Unlock()
+		return s, nil
 	}
-	key, err := ioutil.ReadFile(kf)
+	signerCacheMu.Unlock()
+
+	key, err := ioutil.ReadFile(abs)
 	if err != nil {
-		return fmt.Errorf("unable to read private key %q: %v", kf, err)
+		return nil, fmt.Errorf("unable to read private key: %v", err)
 	}
 
 	signer, err := ssh.ParsePrivateKey(key)
 	if err != nil {
-		return fmt.Errorf("ParsePrivateKey %q: %v", kf, err)
+		var passErr *ssh.PassphraseMissingError
+		if !errors.As(err, &passErr) {
+			return nil, fmt.Errorf("ParsePrivateKey: %v", err)
+		}
+		signer, err = c.decryptSigner(abs, key)
+		if err != nil {
+			return nil, err
+		}
 	}
-	c.config.Auth = append(c.config.Auth, ssh.PublicKeys(signer))
-	return nil
+
+	signerCacheMu.Lock()
+	signerCache[abs] = signer
+	signerCacheMu.Unlock()
+	return signer, nil
+}
+
+// decryptSigner resolves a passphrase-protected private key, preferring
+// a matching key in a running ssh-agent over c.PassphrasePrompt.
+func (c *Cmd) decryptSigner(abs string, key []byte) (ssh.Signer, error) {
+	if s, err := agentSignerForPublicKey(abs + ".pub"); err == nil {
+		V("using agent key for %q", abs)
+		return s, nil
+	}
+	if c.PassphrasePrompt == nil {
+		return nil, fmt.Errorf("key is encrypted, no matching agent key, and PassphrasePrompt is not set")
+	}
+	pass, err := c.PassphrasePrompt(abs)
+	if err != nil {
+		return nil, fmt.Errorf("PassphrasePrompt: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(key, pass)
+	if err != nil {
+		return nil, fmt.Errorf("ParsePrivateKeyWithPassphrase: %v", err)
+	}
+	return signer, nil
+}
+
+// agentSigners returns every signer offered by the ssh-agent at
+// SSH_AUTH_SOCK, reusing the cached connection from cachedAgent.
+func agentSigners() ([]ssh.Signer, error) {
+	a, err := cachedAgent()
+	if err != nil {
+		return nil, err
+	}
+	return a.Signers()
+}
+
+// agentSignerForPublicKey returns the agent signer whose public key
+// matches the one stored at pubPath, or an error if there is no agent,
+// no such public key file, or no matching key in the agent.
+func agentSignerForPublicKey(pubPath string) (ssh.Signer, error) {
+	pub, err := ioutil.ReadFile(pubPath)
+	if err != nil {
+		return nil, fmt.Errorf("no public key at %q: %v", pubPath, err)
+	}
+	want, _, _, _, err := ssh.ParseAuthorizedKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("parse %q: %v", pubPath, err)
+	}
+	signers, err := agentSigners()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range signers {
+		if bytes.Equal(s.PublicKey().Marshal(), want.Marshal()) {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("no matching key for %q in agent", pubPath)
+}
+
+// cachedAgent connects to the ssh-agent named by SSH_AUTH_SOCK, if any,
+// reusing the same connection on every call: each of the signers
+// agentSigners returns keeps using this connection to perform the
+// actual signing, so, unlike a plain lookup helper, this must not be
+// closed once the signers are handed out.
+func cachedAgent() (agent.Agent, error) {
+	agentMu.Lock()
+	defer agentMu.Unlock()
+	if cachedAgentClient != nil {
+		return cachedAgentClient, nil
+	}
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if len(sock) == 0 {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("dial agent at %q: %v", sock, err)
+	}
+	cachedAgentClient = agent.NewClient(conn)
+	return cachedAgentClient, nil
 }
 
-// HostKeyConfig sets the host key. It is optional.
+// HostKeyConfig sets a single fixed host key. It is optional, and is
+// kept only for backward compatibility: it is a thin wrapper around the
+// ssh.FixedHostKey callback, with none of KnownHostsConfig's support for
+// multiple hosts, hashed names, revocation, or trust-on-first-use.
+// New code should prefer KnownHostsConfig.
 func (c *Cmd) HostKeyConfig(hostKeyFile string) error {
 	hk, err := ioutil.ReadFile(hostKeyFile)
 	if err != nil {
@@ -0,0 +1,148 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	ssh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// userKnownHostsFile is the per-user known_hosts file. KnownHostsConfig
+// always bootstraps it before doing anything else, so first-contact
+// TOFU always has somewhere of the user's own to persist to, even when
+// a read-only system-wide file (e.g. a distro- or image-shipped
+// /etc/ssh/ssh_known_hosts) is the only other candidate present.
+func userKnownHostsFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh/known_hosts")
+}
+
+// defaultKnownHostsFiles returns the standard system-wide known_hosts
+// locations consulted in addition to userKnownHostsFile and any
+// caller-supplied files.
+func defaultKnownHostsFiles() []string {
+	return []string{"/etc/ssh/ssh_known_hosts"}
+}
+
+// KnownHostsConfig sets c.config.HostKeyCallback from one or more
+// known_hosts-format files: ~/.ssh/known_hosts and
+// /etc/ssh/ssh_known_hosts are always consulted, in addition to any
+// files passed in. Hashed hostnames, @revoked markers, and
+// @cert-authority entries are all honored, since verification is
+// delegated to golang.org/x/crypto/ssh/knownhosts.
+//
+// A host that is present but whose key no longer matches produces the
+// knownhosts package's *knownhosts.KeyError verbatim, wrapped with a
+// "REMOTE HOST IDENTIFICATION HAS CHANGED" message, exactly as ssh(1)
+// would report it.
+//
+// A host that is simply unknown is handed to c.HostKeyPrompt, if set;
+// if the prompt accepts the key and asks for it to be persisted, a line
+// is appended to the first writable file among those consulted, which
+// is always userKnownHostsFile unless it could not be created.
+//
+// userKnownHostsFile is created (empty, if it didn't already exist)
+// unconditionally, before anything else is checked, so TOFU always has
+// somewhere of the user's own to write its first line to, even when a
+// read-only system-wide known_hosts file already exists - exactly as
+// ssh(1) creates ~/.ssh/known_hosts on the first accepted key.
+func (c *Cmd) KnownHostsConfig(files ...string) error {
+	primary := userKnownHostsFile()
+	if err := createKnownHostsFile(primary); err != nil {
+		return fmt.Errorf("bootstrapping %q: %v", primary, err)
+	}
+
+	all := append([]string{primary}, append(defaultKnownHostsFiles(), files...)...)
+	var existing []string
+	for _, f := range all {
+		if _, err := os.Stat(f); err == nil {
+			existing = append(existing, f)
+		}
+	}
+
+	cb, err := knownhosts.New(existing...)
+	if err != nil {
+		return fmt.Errorf("knownhosts.New(%q): %v", existing, err)
+	}
+
+	c.config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := cb(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) != 0 {
+			// The host is known, but offered a different key: this is
+			// the case ssh(1) treats as a possible MITM attack.
+			return fmt.Errorf("REMOTE HOST IDENTIFICATION HAS CHANGED for %q: %w", hostname, err)
+		}
+		// Want is empty: the host simply isn't in any known_hosts file yet.
+		if c.HostKeyPrompt == nil {
+			return fmt.Errorf("unknown host %q and no HostKeyPrompt set: %w", hostname, err)
+		}
+		accept, persist, err := c.HostKeyPrompt(hostname, remote, key)
+		if err != nil {
+			return fmt.Errorf("HostKeyPrompt for %q: %v", hostname, err)
+		}
+		if !accept {
+			return fmt.Errorf("host key for %q rejected", hostname)
+		}
+		if persist {
+			if err := appendKnownHost(existing, hostname, key); err != nil {
+				return fmt.Errorf("persisting host key for %q: %v", hostname, err)
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// createKnownHostsFile creates path, and the directory containing it,
+// if they do not already exist, so knownhosts.New has something to
+// read and appendKnownHost has something to append to.
+func createKnownHostsFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("mkdir %q: %v", filepath.Dir(path), err)
+	}
+	fh, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return fh.Close()
+}
+
+// appendKnownHost appends a known_hosts line for host/key to the first
+// writable file in files, creating it (and its directory) first if
+// necessary.
+func appendKnownHost(files []string, host string, key ssh.PublicKey) error {
+	line := knownhosts.Line([]string{host}, key) + "\n"
+	var errs []error
+	for _, f := range files {
+		if err := createKnownHostsFile(f); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fh, err := os.OpenFile(f, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		defer fh.Close()
+		if _, err := fh.WriteString(line); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("no writable known_hosts file among %q: %v", files, errs)
+}
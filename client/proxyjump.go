@@ -0,0 +1,162 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	config "github.com/kevinburke/ssh_config"
+	ssh "golang.org/x/crypto/ssh"
+)
+
+// proxyJumpHosts returns the ordered list of bastion hosts to dial
+// through before reaching the final target: c.ProxyJump if it is set,
+// else ssh_config's ProxyJump directive for c.Host, split on commas.
+func (c *Cmd) proxyJumpHosts() []string {
+	if len(c.ProxyJump) != 0 {
+		return c.ProxyJump
+	}
+	pj := config.Get(c.Host, "ProxyJump")
+	if len(pj) == 0 {
+		return nil
+	}
+	var hops []string
+	for _, h := range strings.Split(pj, ",") {
+		if h = strings.TrimSpace(h); len(h) != 0 {
+			hops = append(hops, h)
+		}
+	}
+	return hops
+}
+
+// hopDialAddress turns a ProxyJump hop, which may be a bare host, a
+// user@host, or a host:port, into a "host:port" dial address, using the
+// same ssh_config HostName/Port lookups as the rest of this package. If
+// hop carries a user@ prefix, it is returned separately, so the caller
+// can log into that hop as that user rather than the final target's
+// user.
+func hopDialAddress(hop string) (addr, user string) {
+	host := hop
+	if i := strings.LastIndex(hop, "@"); i >= 0 {
+		user, host = hop[:i], hop[i+1:]
+	}
+	if strings.Contains(host, ":") {
+		return host, user
+	}
+	host = GetHostName(host)
+	port, _ := GetPort(host, "")
+	return net.JoinHostPort(host, port), user
+}
+
+// hopConfig returns a copy of c.config with User overridden to user
+// when user is non-empty, so a "user@bastion" ProxyJump hop logs into
+// the bastion as that user even when c.config.User (the final target's
+// user) differs.
+func (c *Cmd) hopConfig(user string) *ssh.ClientConfig {
+	cfg := c.config
+	if len(user) != 0 {
+		cfg.User = user
+	}
+	return &cfg
+}
+
+// JumpClient is the result of a (possibly multi-hop) DialProxyJump: the
+// final *ssh.Client, plus every intermediate bastion hop that was
+// dialled to reach it. It can be used exactly like an *ssh.Client -
+// NewSession and the rest are promoted from the embedded client - but
+// callers must Close the JumpClient, not the embedded client directly,
+// so tearing down the session also tears down every intermediate hop
+// instead of leaking one TCP connection and reader goroutine per hop
+// for the life of the process.
+type JumpClient struct {
+	*ssh.Client
+	hops []*ssh.Client // intermediate hops, in dial order.
+}
+
+// Close closes the final client, then every intermediate hop in
+// reverse dial order (the most recently dialled bastion first), same
+// as a manual teardown of the chain would.
+func (j *JumpClient) Close() error {
+	err := j.Client.Close()
+	for i := len(j.hops) - 1; i >= 0; i-- {
+		if hErr := j.hops[i].Close(); hErr != nil && err == nil {
+			err = hErr
+		}
+	}
+	return err
+}
+
+// DialProxyJump opens an SSH connection to addr, chaining through
+// c.proxyJumpHosts() first, exactly as ssh(1) -J does: the first hop is
+// dialled directly, and every hop after it is opened as a "tcp" channel
+// over the previous hop's connection and then given its own SSH
+// handshake. Every hop is authenticated with c.config (overridden per
+// hop by a leading "user@", if present), so the signer cache in
+// UserKeyConfig means a given passphrase is asked for at most once, no
+// matter how many hops need it.
+//
+// The returned *JumpClient keeps every intermediate hop alive for as
+// long as the final connection is in use; its Close tears all of them
+// down together. If any hop fails to dial, every hop already connected
+// is closed before the error is returned.
+func (c *Cmd) DialProxyJump(addr string) (*JumpClient, error) {
+	var chain []*ssh.Client
+	closeChain := func() {
+		for i := len(chain) - 1; i >= 0; i-- {
+			chain[i].Close()
+		}
+	}
+	dial := func(next string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+		if len(chain) == 0 {
+			return ssh.Dial("tcp", next, cfg)
+		}
+		return dialNextHop(chain[len(chain)-1], next, cfg)
+	}
+
+	for i, hop := range c.proxyJumpHosts() {
+		next, user := hopDialAddress(hop)
+		nc, err := dial(next, c.hopConfig(user))
+		if err != nil {
+			closeChain()
+			return nil, fmt.Errorf("ProxyJump hop %d (%s): %w", i, hop, err)
+		}
+		chain = append(chain, nc)
+	}
+
+	final, err := dial(addr, &c.config)
+	if err != nil {
+		closeChain()
+		return nil, err
+	}
+	return &JumpClient{Client: final, hops: chain}, nil
+}
+
+// dialNextHop opens a TCP channel to addr over an already-established
+// SSH connection, via, and negotiates a new, independent SSH connection
+// over it.
+func dialNextHop(via *ssh.Client, addr string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial %q via previous hop: %w", addr, err)
+	}
+	ncc, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if err != nil {
+		return nil, fmt.Errorf("handshake with %q via previous hop: %w", addr, err)
+	}
+	return ssh.NewClient(ncc, chans, reqs), nil
+}
+
+// RefuseProxyJump returns an error if ProxyJump is configured for c.
+// The vsock and direct-TCP dial paths, which have no notion of a
+// bastion hop, call this so a ProxyJump in ssh_config or on the command
+// line is rejected explicitly instead of being silently ignored.
+func (c *Cmd) RefuseProxyJump(path string) error {
+	if hops := c.proxyJumpHosts(); len(hops) != 0 {
+		return fmt.Errorf("%s does not support ProxyJump (got %q)", path, hops)
+	}
+	return nil
+}
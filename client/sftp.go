@@ -0,0 +1,143 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/pkg/sftp"
+)
+
+// NamespaceMode selects how cpud is told to obtain the client's
+// exported namespace.
+type NamespaceMode int
+
+const (
+	// Namespace9P forwards the namespace over 9P, as cpu has always done.
+	Namespace9P NamespaceMode = iota
+	// NamespaceSFTP pulls files over the SSH connection's SFTP
+	// subsystem instead, for servers (stock OpenSSH, containers
+	// without v9fs) that have no 9P support at all.
+	NamespaceSFTP
+	// NamespaceNone disables namespace forwarding entirely.
+	NamespaceNone
+)
+
+// namespaceModeEnv is the environment variable cpu sets, and cpud reads,
+// to learn which NamespaceMode a session negotiated.
+const namespaceModeEnv = "CPU_NAMESPACE_MODE"
+
+// sftpSubsystemName is the SSH subsystem cpud registers to accept an
+// SFTP-mode namespace pull.
+const sftpSubsystemName = "cpu-sftp"
+
+// String implements fmt.Stringer, using the same names exchanged over
+// namespaceModeEnv.
+func (m NamespaceMode) String() string {
+	switch m {
+	case Namespace9P:
+		return "9p"
+	case NamespaceSFTP:
+		return "sftp"
+	case NamespaceNone:
+		return "none"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseNamespaceMode is the inverse of NamespaceMode.String.
+func ParseNamespaceMode(s string) (NamespaceMode, error) {
+	switch s {
+	case "9p":
+		return Namespace9P, nil
+	case "sftp":
+		return NamespaceSFTP, nil
+	case "none", "":
+		return NamespaceNone, nil
+	default:
+		return NamespaceNone, fmt.Errorf("unknown namespace mode %q", s)
+	}
+}
+
+// NegotiateNamespaceMode tells cpud, via namespaceModeEnv, which
+// NamespaceMode to use: c.NamespaceMode if the server advertises
+// support for it, else NamespaceNone. advertised is the set of modes
+// the server is known to support, however that was learned (e.g. a
+// prior control message or a fixed assumption about the target).
+func (c *Cmd) NegotiateNamespaceMode(advertised []NamespaceMode) error {
+	for _, m := range advertised {
+		if m == c.NamespaceMode {
+			return c.SetEnv(namespaceModeEnv + "=" + c.NamespaceMode.String())
+		}
+	}
+	c.NamespaceMode = NamespaceNone
+	return c.SetEnv(namespaceModeEnv + "=" + NamespaceNone.String())
+}
+
+// rwc adapts a session's stdin/stdout pipes into the
+// io.ReadWriteCloser pkg/sftp's Server wants.
+type rwc struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// ServeSFTPNamespace answers cpud's SFTP pull requests for the client's
+// namespace. It must be called after session.Start: it opens a second
+// session on the same SSH connection and requests the cpu-sftp
+// subsystem. On the other end, cpud acts as the SFTP client, pulling
+// whatever files it needs under the subtrees parseBinds(binds, ...)
+// exports, and writing them under filepath.Join(TmpMnt, "cpu", remote).
+// This reaches servers 9P can't (stock OpenSSH, containers without
+// v9fs), at the cost of being a one-time pull rather than a live
+// namespace: local changes made after the pull are not reflected
+// remotely.
+//
+// The SFTP server is restricted, via restrictedFS, to exactly the
+// local-side subtrees binds names: a request for any other path is
+// rejected, so a compromised or merely buggy cpud cannot read
+// arbitrary files off the client.
+func (c *Cmd) ServeSFTPNamespace(binds string) error {
+	fs, err := newRestrictedFS(binds, c.TmpMnt)
+	if err != nil {
+		return fmt.Errorf("ServeSFTPNamespace: %w", err)
+	}
+
+	sess, err := c.client.NewSession()
+	if err != nil {
+		return fmt.Errorf("SFTP subsystem session: %w", err)
+	}
+
+	requests, err := sess.StdoutPipe()
+	if err != nil {
+		sess.Close()
+		return fmt.Errorf("SFTP subsystem stdout: %w", err)
+	}
+	responses, err := sess.StdinPipe()
+	if err != nil {
+		sess.Close()
+		return fmt.Errorf("SFTP subsystem stdin: %w", err)
+	}
+	if err := sess.RequestSubsystem(sftpSubsystemName); err != nil {
+		sess.Close()
+		return fmt.Errorf("request %q subsystem: %w", sftpSubsystemName, err)
+	}
+
+	srv := sftp.NewRequestServer(rwc{requests, responses}, sftp.Handlers{
+		FileGet:  fs,
+		FilePut:  fs,
+		FileCmd:  fs,
+		FileList: fs,
+	})
+	go func() {
+		defer sess.Close()
+		defer srv.Close()
+		if err := srv.Serve(); err != nil && err != io.EOF {
+			verbose("SFTP namespace server: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// boundExport is one local=remote pair from a CPU_NAMESPACE-style
+// binds string, as parsed for ServeSFTPNamespace.
+type boundExport struct {
+	local string
+}
+
+// parseBoundExports returns the local-side path of each entry in
+// binds: the set of subtrees restrictedFS is allowed to serve.
+//
+// binds is split the same way parseBinds splits it - on ":" between
+// entries, then on the first "=" within one - rather than recovered by
+// re-splitting parseBinds' fstab-format output on whitespace, since a
+// local path containing a space would be silently truncated by that
+// round trip. parseBinds itself is still called first, purely to reuse
+// its syntax validation and error messages.
+func parseBoundExports(binds, tmp string) ([]boundExport, error) {
+	if _, err := parseBinds(binds, tmp); err != nil {
+		return nil, err
+	}
+	if len(binds) == 0 {
+		return nil, nil
+	}
+	var exports []boundExport
+	for _, bind := range strings.Split(binds, ":") {
+		local := strings.SplitN(bind, "=", 2)[0]
+		exports = append(exports, boundExport{local: local})
+	}
+	return exports, nil
+}
+
+// restrictedFS is an sftp.Handlers implementation that serves the OS
+// filesystem, but only the subtrees named by roots: any request whose
+// path falls outside all of them is rejected. This is what keeps
+// ServeSFTPNamespace's SFTP pull scoped to the same subtrees 9P mode
+// would have exported, instead of handing cpud the whole local
+// filesystem.
+//
+// It does not resolve symlinks before the containment check, so a
+// symlink inside an exported subtree that points outside it is not
+// caught; this matches the trust model of bind mounts in 9P mode, which
+// likewise don't chase host-side symlinks out of the export.
+type restrictedFS struct {
+	roots []string // absolute, cleaned allowed path prefixes
+}
+
+// newRestrictedFS builds a restrictedFS whose roots are the local-side
+// paths parseBoundExports derives from binds.
+func newRestrictedFS(binds, tmp string) (*restrictedFS, error) {
+	exports, err := parseBoundExports(binds, tmp)
+	if err != nil {
+		return nil, err
+	}
+	fs := &restrictedFS{}
+	for _, e := range exports {
+		abs, err := filepath.Abs(e.local)
+		if err != nil {
+			return nil, fmt.Errorf("bind local path %q: %v", e.local, err)
+		}
+		fs.roots = append(fs.roots, filepath.Clean(abs))
+	}
+	return fs, nil
+}
+
+// allowed reports whether path is one of fs.roots, or falls under one.
+func (fs *restrictedFS) allowed(path string) bool {
+	path = filepath.Clean(path)
+	for _, root := range fs.roots {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPath rejects r unless its path is allowed.
+func (fs *restrictedFS) checkPath(r *sftp.Request) error {
+	if !fs.allowed(r.Filepath) {
+		return fmt.Errorf("sftp: %q is outside the exported namespace", r.Filepath)
+	}
+	return nil
+}
+
+// Fileread implements sftp.FileReader.
+func (fs *restrictedFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	if err := fs.checkPath(r); err != nil {
+		return nil, err
+	}
+	return os.Open(r.Filepath)
+}
+
+// Filewrite implements sftp.FileWriter. ServeSFTPNamespace is a pull
+// model only: the client's namespace is read-only to cpud.
+func (fs *restrictedFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return nil, fmt.Errorf("sftp: writes are not supported by ServeSFTPNamespace")
+}
+
+// Filecmd implements sftp.FileCmder. Remove/Rename/Mkdir and friends
+// are refused for the same reason writes are.
+func (fs *restrictedFS) Filecmd(r *sftp.Request) error {
+	return fmt.Errorf("sftp: %s is not supported by ServeSFTPNamespace", r.Method)
+}
+
+// Filelist implements sftp.FileLister, supporting the List and Stat
+// methods pkg/sftp needs to walk and identify files within the
+// exported subtrees.
+func (fs *restrictedFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	if err := fs.checkPath(r); err != nil {
+		return nil, err
+	}
+	switch r.Method {
+	case "List":
+		entries, err := ioutil.ReadDir(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return fileInfoListerAt(entries), nil
+	case "Stat":
+		fi, err := os.Stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return fileInfoListerAt{fi}, nil
+	default:
+		return nil, fmt.Errorf("sftp: unsupported list method %q", r.Method)
+	}
+}
+
+// fileInfoListerAt implements sftp.ListerAt over an in-memory slice of
+// os.FileInfo, as both the List and Stat Filelist methods need.
+type fileInfoListerAt []os.FileInfo
+
+func (l fileInfoListerAt) ListAt(dst []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(dst, l[offset:])
+	if n < len(dst) {
+		return n, io.EOF
+	}
+	return n, nil
+}
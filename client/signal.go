@@ -0,0 +1,107 @@
+// Copyright 2018-2019 the u-root Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	ssh "golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// signalMap translates the subset of Unix signals ForwardSignals
+// forwards into their ssh.Signal equivalents.
+var signalMap = map[syscall.Signal]ssh.Signal{
+	syscall.SIGINT:  ssh.SIGINT,
+	syscall.SIGTERM: ssh.SIGTERM,
+	syscall.SIGQUIT: ssh.SIGQUIT,
+	syscall.SIGHUP:  ssh.SIGHUP,
+	syscall.SIGUSR1: ssh.SIGUSR1,
+	syscall.SIGUSR2: ssh.SIGUSR2,
+}
+
+// ForwardSignals installs handlers for SIGINT, SIGTERM, SIGQUIT,
+// SIGHUP, SIGUSR1, SIGUSR2, and SIGWINCH, and forwards each to the
+// remote session until ctx is done. SIGWINCH queries the current TTY
+// size and issues session.WindowChange; the rest map to the
+// corresponding ssh.Signal constant via signalMap and are sent with
+// session.Signal.
+//
+// Callers using SSHStdin's ~. escape to close the session should cancel
+// ctx before, or as part of, that close: otherwise a signal arriving
+// during teardown can race a Signal call against an already-closed
+// session.
+func (c *Cmd) ForwardSignals(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs,
+		syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP,
+		syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGWINCH)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case s := <-sigs:
+				c.forwardOneSignal(s)
+			}
+		}
+	}()
+}
+
+// forwardOneSignal forwards a single signal received by ForwardSignals.
+func (c *Cmd) forwardOneSignal(s os.Signal) {
+	if s == syscall.SIGWINCH {
+		width, height, err := term.GetSize(int(os.Stdin.Fd()))
+		if err != nil {
+			verbose("ForwardSignals: GetSize: %v", err)
+			return
+		}
+		if err := c.session.WindowChange(height, width); err != nil {
+			verbose("ForwardSignals: WindowChange: %v", err)
+		}
+		return
+	}
+	sig, ok := signalMap[s.(syscall.Signal)]
+	if !ok {
+		return
+	}
+	if err := c.session.Signal(sig); err != nil {
+		verbose("ForwardSignals: Signal(%v): %v", sig, err)
+	}
+}
+
+// forceCommand returns the command the remote session should actually
+// run: if c.ForceCommand is set, argv is exported as
+// SSH_ORIGINAL_COMMAND (the same environment variable sshd's
+// ForceCommand directive and authorized_keys' command= populate) and
+// c.ForceCommand is returned in its place. Otherwise argv is returned
+// unchanged.
+//
+// c.ForceCommand is advisory only, not an access-control mechanism: it
+// is a field on the client's own Cmd, so it only takes effect when this
+// client chooses to call forceCommand, and nothing here stops a
+// different, unmodified client from presenting the same credential and
+// requesting whatever command it likes. Actually restricting what a
+// given key is allowed to run requires cpud to enforce the restriction
+// itself, server-side, keyed off the authenticated credential - the
+// same way sshd enforces its own ForceCommand/command= - which is
+// outside what this package can do on its own.
+//
+// Callers building the session's Run/Start argument should pass it
+// through forceCommand first.
+func (c *Cmd) forceCommand(argv string) (string, error) {
+	if len(c.ForceCommand) == 0 {
+		return argv, nil
+	}
+	if err := c.SetEnv("SSH_ORIGINAL_COMMAND=" + argv); err != nil {
+		return "", fmt.Errorf("ForceCommand: %v", err)
+	}
+	return c.ForceCommand, nil
+}